@@ -0,0 +1,196 @@
+package runtime
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/runatlantis/atlantis/server/logging"
+)
+
+var (
+	tfeAPIRequestsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "atlantis_tfe_api_requests_total",
+		Help: "Total number of remote ops determinations that called the TFE API (each makes one or more API requests).",
+	})
+	tfeAPIErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "atlantis_tfe_api_errors_total",
+		Help: "Total number of errors encountered calling the TFE API to determine remote ops usage.",
+	})
+	tfeAPICacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "atlantis_tfe_remote_ops_cache_hits_total",
+		Help: "Total number of remote ops determinations served from cache.",
+	})
+	tfeAPICacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "atlantis_tfe_remote_ops_cache_misses_total",
+		Help: "Total number of remote ops determinations that required a TFE API call.",
+	})
+)
+
+// remoteOpsCacheKey identifies a remote ops determination. We deliberately
+// don't resolve tag-based workspace selectors to their underlying TFE
+// workspace name here (that itself requires an API call) and instead key
+// on the raw selector. A tag selector alone doesn't pin down a workspace,
+// since the selected one comes from the project's .terraform/environment,
+// so for tags the project path is made part of the key as well.
+type remoteOpsCacheKey struct {
+	hostname     string
+	organization string
+	workspace    string
+}
+
+// remoteOpsCacheEntry only ever holds a successful determination. Errors
+// (including rate limiting, which go-tfe's own retryablehttp transport
+// already retries internally with backoff honoring Retry-After) are never
+// cached, so a transient failure can't get stuck and replayed to every
+// plan/apply for the rest of the TTL window.
+type remoteOpsCacheEntry struct {
+	usingRemoteOps bool
+	expiresAt      time.Time
+}
+
+// remoteOpsBackendChecker is the seam CachingRemoteOpsChecker wraps.
+// Parsing a project's backend config is needed just to compute a cache key
+// and is cheap enough to always do, while actually consulting TFE
+// (usingRemoteOpsForBackend) is the expensive part the cache exists to
+// avoid repeating. Splitting them into two methods lets UsingRemoteOps
+// parse the statefile exactly once per call regardless of cache hit/miss,
+// and lets tests substitute a call-counting fake for the TFE-calling half.
+type remoteOpsBackendChecker interface {
+	parseBackend(log *logging.SimpleLogger, projectAbsPath string) (bool, RemoteBackend, error)
+	usingRemoteOpsForBackend(log *logging.SimpleLogger, workspace string, projectAbsPath string, backend RemoteBackend) (bool, error)
+}
+
+// CachingRemoteOpsChecker wraps a DefaultRemoteOpsChecker so that repeated
+// plan/apply calls against the same project don't each cost two TFE API
+// round-trips (Organizations.Entitlements + Workspaces.Read). The statefile
+// is still read on every call to compute the cache key. Entries are cached
+// for TTL and served from memory until they expire or FlushCache is called.
+type CachingRemoteOpsChecker struct {
+	Checker remoteOpsBackendChecker
+	TTL     time.Duration
+
+	mu    sync.Mutex
+	cache map[remoteOpsCacheKey]remoteOpsCacheEntry
+}
+
+// NewCachingRemoteOpsChecker wraps checker with a cache using the given TTL.
+func NewCachingRemoteOpsChecker(checker *DefaultRemoteOpsChecker, ttl time.Duration) *CachingRemoteOpsChecker {
+	return &CachingRemoteOpsChecker{
+		Checker: checker,
+		TTL:     ttl,
+		cache:   make(map[remoteOpsCacheKey]remoteOpsCacheEntry),
+	}
+}
+
+func (c *CachingRemoteOpsChecker) UsingRemoteOps(log *logging.SimpleLogger, workspace string, projectAbsPath string) (bool, error) {
+	isRemote, backend, err := c.Checker.parseBackend(log, projectAbsPath)
+	if err != nil {
+		return false, err
+	}
+	if !isRemote {
+		return false, nil
+	}
+
+	selector := backend.WorkspaceName
+	if selector == "" && backend.WorkspaceTags != "" {
+		selector = "tags:" + backend.WorkspaceTags + "@" + projectAbsPath
+	}
+	if selector == "" && backend.WorkspacePrefix != "" {
+		selector = backend.WorkspacePrefix + workspace
+	}
+	key := remoteOpsCacheKey{
+		hostname:     backend.Hostname,
+		organization: backend.Organization,
+		workspace:    selector,
+	}
+
+	if entry, ok := c.get(key); ok {
+		log.Debug("serving remote ops determination for %+v from cache", key)
+		tfeAPICacheHitsTotal.Inc()
+		return entry.usingRemoteOps, nil
+	}
+	tfeAPICacheMissesTotal.Inc()
+
+	tfeAPIRequestsTotal.Inc()
+	usingRemoteOps, err := c.Checker.usingRemoteOpsForBackend(log, workspace, projectAbsPath, backend)
+	if err != nil {
+		// go-tfe's own retryablehttp-based transport already retries rate
+		// limited (429) requests internally with exponential backoff
+		// honoring Retry-After, so there's nothing useful for us to add by
+		// retrying again here. We also don't cache the error: caching it
+		// would replay an unrelated transient failure to every plan/apply
+		// for the rest of the TTL instead of letting the next call retry.
+		tfeAPIErrorsTotal.Inc()
+		return false, err
+	}
+
+	c.set(key, remoteOpsCacheEntry{
+		usingRemoteOps: usingRemoteOps,
+		expiresAt:      time.Now().Add(c.TTL),
+	})
+	return usingRemoteOps, nil
+}
+
+func (c *CachingRemoteOpsChecker) get(key remoteOpsCacheKey) (remoteOpsCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.cache[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return remoteOpsCacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *CachingRemoteOpsChecker) set(key remoteOpsCacheKey, entry remoteOpsCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cache[key] = entry
+}
+
+// FlushCache empties the cache, for example after entitlements change for
+// an organization and operators don't want to wait out the TTL.
+func (c *CachingRemoteOpsChecker) FlushCache() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cache = make(map[remoteOpsCacheKey]remoteOpsCacheEntry)
+}
+
+// FlushCacheHandler returns an http.HandlerFunc suitable for mounting on
+// Atlantis' admin/internal router (e.g. POST /admin/tfe-cache/flush) so
+// operators can invalidate the cache without sending a signal.
+func (c *CachingRemoteOpsChecker) FlushCacheHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		c.FlushCache()
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// ListenForSIGHUP flushes the cache every time this process receives
+// SIGHUP, letting operators invalidate it (e.g. `kill -HUP <pid>`) without
+// restarting Atlantis. It runs until stop is closed.
+func (c *CachingRemoteOpsChecker) ListenForSIGHUP(log *logging.SimpleLogger, stop <-chan struct{}) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-sighup:
+				log.Info("received SIGHUP, flushing remote ops cache")
+				c.FlushCache()
+			case <-stop:
+				signal.Stop(sighup)
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package runtime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/runatlantis/atlantis/server/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBackendChecker implements remoteOpsBackendChecker, counting calls to
+// each method so tests can assert a cache hit genuinely skips the
+// TFE-calling step, and that a cache miss parses the backend exactly once.
+type fakeBackendChecker struct {
+	backend RemoteBackend
+
+	parseBackendCalls   int
+	usingRemoteOpsCalls int
+	usingRemoteOps      bool
+}
+
+func (f *fakeBackendChecker) parseBackend(log *logging.SimpleLogger, projectAbsPath string) (bool, RemoteBackend, error) {
+	f.parseBackendCalls++
+	return true, f.backend, nil
+}
+
+func (f *fakeBackendChecker) usingRemoteOpsForBackend(log *logging.SimpleLogger, workspace string, projectAbsPath string, backend RemoteBackend) (bool, error) {
+	f.usingRemoteOpsCalls++
+	return f.usingRemoteOps, nil
+}
+
+func TestCachingRemoteOpsChecker_MissCallsCheckerOnceThenHitSkipsIt(t *testing.T) {
+	fake := &fakeBackendChecker{
+		backend:        RemoteBackend{Hostname: "app.terraform.io", Organization: "acme", WorkspaceName: "prod"},
+		usingRemoteOps: true,
+	}
+	c := &CachingRemoteOpsChecker{Checker: fake, TTL: time.Minute, cache: make(map[remoteOpsCacheKey]remoteOpsCacheEntry)}
+	log := &logging.SimpleLogger{}
+
+	result, err := c.UsingRemoteOps(log, "default", "/tmp/project")
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 1, fake.parseBackendCalls)
+	assert.Equal(t, 1, fake.usingRemoteOpsCalls)
+
+	result, err = c.UsingRemoteOps(log, "default", "/tmp/project")
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 2, fake.parseBackendCalls, "parseBackend is cheap and always needed to compute the cache key")
+	assert.Equal(t, 1, fake.usingRemoteOpsCalls, "a cache hit must not call through to the TFE-calling step again")
+}
+
+func TestCachingRemoteOpsChecker_GetSetExpiry(t *testing.T) {
+	c := NewCachingRemoteOpsChecker(&DefaultRemoteOpsChecker{}, time.Minute)
+	key := remoteOpsCacheKey{hostname: "app.terraform.io", organization: "acme", workspace: "prod"}
+
+	_, ok := c.get(key)
+	assert.False(t, ok, "expected cache miss before anything is cached")
+
+	c.set(key, remoteOpsCacheEntry{usingRemoteOps: true, expiresAt: time.Now().Add(time.Minute)})
+	entry, ok := c.get(key)
+	assert.True(t, ok)
+	assert.True(t, entry.usingRemoteOps)
+
+	c.set(key, remoteOpsCacheEntry{usingRemoteOps: true, expiresAt: time.Now().Add(-time.Minute)})
+	_, ok = c.get(key)
+	assert.False(t, ok, "expected expired entry to be treated as a miss")
+}
+
+func TestCachingRemoteOpsChecker_FlushCache(t *testing.T) {
+	c := NewCachingRemoteOpsChecker(&DefaultRemoteOpsChecker{}, time.Minute)
+	key := remoteOpsCacheKey{hostname: "app.terraform.io", organization: "acme", workspace: "prod"}
+	c.set(key, remoteOpsCacheEntry{usingRemoteOps: true, expiresAt: time.Now().Add(time.Minute)})
+
+	c.FlushCache()
+
+	_, ok := c.get(key)
+	assert.False(t, ok, "expected cache to be empty after FlushCache")
+}
@@ -0,0 +1,261 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-tfe"
+	"github.com/hashicorp/hcl"
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+)
+
+// TFECredentialsProvider knows how to find a TFE API token for a given
+// hostname. There are several ways Terraform itself discovers credentials
+// and we want Atlantis to honor the same ones so that operators don't have
+// to configure credentials twice.
+type TFECredentialsProvider interface {
+	// Token returns the token for hostname, or "" if this provider has no
+	// credentials for it. A non-nil error indicates the provider itself
+	// failed, as opposed to simply not having a token.
+	Token(hostname string) (string, error)
+}
+
+// TerraformRCCredentialsProvider reads credentials blocks out of
+// ~/.terraformrc, the way the Terraform CLI does.
+type TerraformRCCredentialsProvider struct{}
+
+func (p *TerraformRCCredentialsProvider) Token(hostname string) (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", errors.Wrap(err, "retrieving token from .terraformrc file")
+	}
+	rcFilePath := filepath.Join(home, ".terraformrc")
+	rcFileBytes, err := ioutil.ReadFile(rcFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.Wrap(err, "retrieving token from .terraformrc file")
+	}
+	obj, err := hcl.Parse(string(rcFileBytes))
+	if err != nil {
+		return "", errors.Wrap(err, "parsing .terraformrc file to retrieve TFE token")
+	}
+
+	type Config struct {
+		Credentials map[string]map[string]interface{} `hcl:"credentials"`
+	}
+	var rcFile Config
+	if err := hcl.DecodeObject(&rcFile, obj); err != nil {
+		return "", errors.Wrap(err, "decoding .terraformrc file to retrieve TFE token")
+	}
+
+	hostnameConf, ok := rcFile.Credentials[hostname]
+	if !ok {
+		return "", nil
+	}
+	tokenGeneric, ok := hostnameConf["token"]
+	if !ok {
+		return "", nil
+	}
+	token, ok := tokenGeneric.(string)
+	if !ok {
+		return "", fmt.Errorf("token for hostname %q in %q is not a string", hostname, rcFilePath)
+	}
+	return token, nil
+}
+
+// EnvVarCredentialsProvider reads tokens from TF_TOKEN_<hostname>
+// environment variables, matching Terraform's own convention for CI
+// environments where dropping a .terraformrc file isn't practical: dots in
+// the hostname become underscores, and since the hostname itself may
+// contain hyphens (which aren't valid in environment variable names),
+// those become double underscores.
+type EnvVarCredentialsProvider struct{}
+
+func (p *EnvVarCredentialsProvider) Token(hostname string) (string, error) {
+	encoded := strings.ReplaceAll(hostname, "-", "__")
+	encoded = strings.ReplaceAll(encoded, ".", "_")
+	return os.Getenv("TF_TOKEN_" + encoded), nil
+}
+
+// CredentialsHelperProvider shells out to an external
+// terraform-credentials-<name> helper binary, the same mechanism
+// Terraform's `credentials_helper` config block uses. The helper is
+// invoked as `terraform-credentials-<name> get <hostname>` and is
+// expected to print a JSON object containing a "token" key on stdout.
+type CredentialsHelperProvider struct {
+	// Name is the helper's name, e.g. "foo" for terraform-credentials-foo.
+	Name string
+	// RunCommand runs the helper and returns its stdout. Overridable in
+	// tests.
+	RunCommand func(name string, args ...string) ([]byte, error)
+}
+
+// NewCredentialsHelperProvider constructs a CredentialsHelperProvider that
+// invokes the real terraform-credentials-<name> binary on PATH.
+func NewCredentialsHelperProvider(name string) *CredentialsHelperProvider {
+	return &CredentialsHelperProvider{
+		Name: name,
+		RunCommand: func(name string, args ...string) ([]byte, error) {
+			return exec.Command(name, args...).Output()
+		},
+	}
+}
+
+func (p *CredentialsHelperProvider) Token(hostname string) (string, error) {
+	out, err := p.RunCommand(fmt.Sprintf("terraform-credentials-%s", p.Name), "get", hostname)
+	if err != nil {
+		return "", errors.Wrapf(err, "running terraform-credentials-%s helper", p.Name)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return "", errors.Wrapf(err, "parsing output of terraform-credentials-%s helper", p.Name)
+	}
+	return resp.Token, nil
+}
+
+// ChainCredentialsProvider tries each of its Providers in order, returning
+// the first non-empty token found. It stops at the first provider that
+// returns an error, and unlike a single provider it returns an error rather
+// than "" when none of its Providers has a token for the hostname.
+type ChainCredentialsProvider struct {
+	Providers []TFECredentialsProvider
+}
+
+// credentialsHelperEnvVar names the terraform-credentials-<name> helper
+// binary Atlantis should shell out to for TFE credentials, mirroring
+// Terraform CLI's own `credentials_helper "<name>" {}` config block. Unset
+// by default, since most installs use a token directly.
+const credentialsHelperEnvVar = "ATLANTIS_TFE_CREDENTIALS_HELPER"
+
+// DefaultCredentialsProviderChain returns the providers Atlantis checks by
+// default, in the order Terraform itself prefers them: environment
+// variables first (since they're explicit and cheap to check), then
+// ~/.terraformrc, then an external credentials helper if one is
+// configured via credentialsHelperEnvVar.
+func DefaultCredentialsProviderChain() *ChainCredentialsProvider {
+	providers := []TFECredentialsProvider{
+		&EnvVarCredentialsProvider{},
+		&TerraformRCCredentialsProvider{},
+	}
+	if helperName := os.Getenv(credentialsHelperEnvVar); helperName != "" {
+		providers = append(providers, NewCredentialsHelperProvider(helperName))
+	}
+	return &ChainCredentialsProvider{Providers: providers}
+}
+
+func (c *ChainCredentialsProvider) Token(hostname string) (string, error) {
+	for _, p := range c.Providers {
+		token, err := p.Token(hostname)
+		if err != nil {
+			return "", err
+		}
+		if token != "" {
+			return token, nil
+		}
+	}
+	return "", fmt.Errorf("found no TFE credentials for hostname %q", hostname)
+}
+
+// discoveredServices is the subset of Terraform's remote service discovery
+// protocol (https://www.terraform.io/internals/remote-service-discovery)
+// that we care about.
+type discoveredServices struct {
+	TFEAPI   string `json:"tfe.v2.1"`
+	StateAPI string `json:"state.v2"`
+}
+
+// discoverTFEHost hits https://<hostname>/.well-known/terraform.json to
+// find where the TFE API actually lives, since it isn't guaranteed to be
+// at the root of hostname. Callers should fall back to hostname itself if
+// discovery fails, since plenty of TFE installs don't serve discovery
+// documents.
+func discoverTFEHost(hostname string) (discoveredServices, error) {
+	url := fmt.Sprintf("https://%s/.well-known/terraform.json", hostname)
+	resp, err := http.Get(url) // #nosec G107 -- hostname comes from the user's own statefile/config
+	if err != nil {
+		return discoveredServices{}, errors.Wrap(err, "fetching terraform.json service discovery document")
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return discoveredServices{}, fmt.Errorf("service discovery document returned status %d", resp.StatusCode)
+	}
+
+	var services discoveredServices
+	if err := json.NewDecoder(resp.Body).Decode(&services); err != nil {
+		return discoveredServices{}, errors.Wrap(err, "decoding terraform.json service discovery document")
+	}
+	return services, nil
+}
+
+// TFEClientFactory builds and caches one authenticated *tfe.Client per
+// hostname so that credential lookup and service discovery only happen
+// once, letting multiple Atlantis workflows (checking remote ops, driving
+// a RemoteRunner, etc.) share the same client instead of each re-reading
+// .terraformrc.
+type TFEClientFactory struct {
+	Credentials TFECredentialsProvider
+
+	mu      sync.Mutex
+	clients map[string]*tfe.Client
+}
+
+// NewTFEClientFactory constructs a TFEClientFactory using the default
+// credentials provider chain.
+func NewTFEClientFactory() *TFEClientFactory {
+	return &TFEClientFactory{
+		Credentials: DefaultCredentialsProviderChain(),
+	}
+}
+
+// ClientFor returns a cached, authenticated client for hostname, creating
+// one if this is the first request for it.
+func (f *TFEClientFactory) ClientFor(hostname string) (*tfe.Client, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.clients == nil {
+		f.clients = make(map[string]*tfe.Client)
+	}
+	if client, ok := f.clients[hostname]; ok {
+		return client, nil
+	}
+
+	token, err := f.Credentials.Token(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	// Discovery is best-effort: plenty of TFE/PTFE installs predate the
+	// discovery protocol or don't serve it behind a proxy, so we just fall
+	// back to go-tfe's default BasePath ("/api/v2/") in that case. Note
+	// that the discovered path must go in Config.BasePath, not baked into
+	// Config.Address -- tfe.NewClient overwrites whatever path Address
+	// carries with BasePath when it builds the base URL.
+	cfg := &tfe.Config{
+		Address: fmt.Sprintf("https://%s", hostname),
+		Token:   token,
+	}
+	if services, discoverErr := discoverTFEHost(hostname); discoverErr == nil && services.TFEAPI != "" {
+		cfg.BasePath = services.TFEAPI
+	}
+
+	client, err := tfe.NewClient(cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating TFE API client for hostname %q", hostname)
+	}
+	f.clients[hostname] = client
+	return client, nil
+}
@@ -0,0 +1,174 @@
+package runtime
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubCredentialsProvider is a TFECredentialsProvider whose Token result is
+// fixed, for exercising ChainCredentialsProvider's fallback ordering.
+type stubCredentialsProvider struct {
+	token string
+	err   error
+}
+
+func (s *stubCredentialsProvider) Token(hostname string) (string, error) {
+	return s.token, s.err
+}
+
+func TestChainCredentialsProvider_FallsThroughToNextProvider(t *testing.T) {
+	chain := &ChainCredentialsProvider{
+		Providers: []TFECredentialsProvider{
+			&stubCredentialsProvider{token: ""},
+			&stubCredentialsProvider{token: "found-it"},
+		},
+	}
+	token, err := chain.Token("app.terraform.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "found-it", token)
+}
+
+func TestChainCredentialsProvider_ReturnsFirstMatch(t *testing.T) {
+	chain := &ChainCredentialsProvider{
+		Providers: []TFECredentialsProvider{
+			&stubCredentialsProvider{token: "first"},
+			&stubCredentialsProvider{token: "second"},
+		},
+	}
+	token, err := chain.Token("app.terraform.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "first", token)
+}
+
+func TestChainCredentialsProvider_NoProviderHasToken(t *testing.T) {
+	chain := &ChainCredentialsProvider{
+		Providers: []TFECredentialsProvider{
+			&stubCredentialsProvider{token: ""},
+			&stubCredentialsProvider{token: ""},
+		},
+	}
+	_, err := chain.Token("app.terraform.io")
+	assert.Error(t, err)
+}
+
+func TestTerraformRCCredentialsProvider_ReadsTokenFromFixture(t *testing.T) {
+	home := t.TempDir()
+	rcContents := `
+credentials "app.terraform.io" {
+  token = "rc-token"
+}
+`
+	err := os.WriteFile(filepath.Join(home, ".terraformrc"), []byte(rcContents), 0600)
+	assert.NoError(t, err)
+
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	defer os.Setenv("HOME", oldHome)
+	homedir.DisableCache = true
+	defer func() { homedir.DisableCache = false }()
+
+	p := &TerraformRCCredentialsProvider{}
+	token, err := p.Token("app.terraform.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "rc-token", token)
+}
+
+func TestTerraformRCCredentialsProvider_NoEntryForHostname(t *testing.T) {
+	home := t.TempDir()
+	rcContents := `
+credentials "app.terraform.io" {
+  token = "rc-token"
+}
+`
+	err := os.WriteFile(filepath.Join(home, ".terraformrc"), []byte(rcContents), 0600)
+	assert.NoError(t, err)
+
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	defer os.Setenv("HOME", oldHome)
+	homedir.DisableCache = true
+	defer func() { homedir.DisableCache = false }()
+
+	p := &TerraformRCCredentialsProvider{}
+	token, err := p.Token("other-tfe.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "", token)
+}
+
+func TestTerraformRCCredentialsProvider_NoFile(t *testing.T) {
+	home := t.TempDir()
+
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	defer os.Setenv("HOME", oldHome)
+	homedir.DisableCache = true
+	defer func() { homedir.DisableCache = false }()
+
+	p := &TerraformRCCredentialsProvider{}
+	token, err := p.Token("app.terraform.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "", token)
+}
+
+func TestEnvVarCredentialsProvider_EncodesHyphensAndDots(t *testing.T) {
+	oldEnv := os.Getenv("TF_TOKEN_my__tfe_example_com")
+	os.Setenv("TF_TOKEN_my__tfe_example_com", "env-token")
+	defer os.Setenv("TF_TOKEN_my__tfe_example_com", oldEnv)
+
+	p := &EnvVarCredentialsProvider{}
+	token, err := p.Token("my-tfe.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "env-token", token)
+}
+
+func TestEnvVarCredentialsProvider_NoMatchingEnvVar(t *testing.T) {
+	p := &EnvVarCredentialsProvider{}
+	token, err := p.Token("unset-hostname.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "", token)
+}
+
+func TestCredentialsHelperProvider_InvokesHelperAndParsesToken(t *testing.T) {
+	var gotName string
+	var gotArgs []string
+	p := &CredentialsHelperProvider{
+		Name: "mycorp",
+		RunCommand: func(name string, args ...string) ([]byte, error) {
+			gotName = name
+			gotArgs = args
+			return []byte(`{"token":"helper-token"}`), nil
+		},
+	}
+	token, err := p.Token("app.terraform.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "helper-token", token)
+	assert.Equal(t, "terraform-credentials-mycorp", gotName)
+	assert.Equal(t, []string{"get", "app.terraform.io"}, gotArgs)
+}
+
+func TestCredentialsHelperProvider_RunCommandError(t *testing.T) {
+	p := &CredentialsHelperProvider{
+		Name: "mycorp",
+		RunCommand: func(name string, args ...string) ([]byte, error) {
+			return nil, fmt.Errorf("boom")
+		},
+	}
+	_, err := p.Token("app.terraform.io")
+	assert.Error(t, err)
+}
+
+func TestCredentialsHelperProvider_InvalidJSON(t *testing.T) {
+	p := &CredentialsHelperProvider{
+		Name: "mycorp",
+		RunCommand: func(name string, args ...string) ([]byte, error) {
+			return []byte("not json"), nil
+		},
+	}
+	_, err := p.Token("app.terraform.io")
+	assert.Error(t, err)
+}
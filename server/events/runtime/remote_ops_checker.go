@@ -5,23 +5,84 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/go-tfe"
-	"github.com/hashicorp/hcl"
-	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"github.com/runatlantis/atlantis/server/logging"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type RemoteOpsChecker interface {
 	UsingRemoteOps(log *logging.SimpleLogger, workspace string, projectAbsPath string) (bool, error)
 }
 
+// DefaultRemoteOpsChecker determines whether a project is using TFE/HCP
+// remote operations. Clients is shared with other workflows (for example
+// RemoteRunner) so that credential lookup and service discovery only
+// happen once per hostname rather than on every check.
 type DefaultRemoteOpsChecker struct {
+	Clients *TFEClientFactory
 }
 
-func (d *DefaultRemoteOpsChecker) UsingRemoteOps(log *logging.SimpleLogger, workspace string, projectAbsPath string) (bool, error) {
+func (d *DefaultRemoteOpsChecker) clients() *TFEClientFactory {
+	if d.Clients == nil {
+		d.Clients = NewTFEClientFactory()
+	}
+	return d.Clients
+}
+
+// RemoteBackend is the remote-ops configuration extracted from a project's
+// statefile, whether it came from a `backend "remote"` block or a `cloud
+// {}` block.
+type RemoteBackend struct {
+	Hostname        string
+	Organization    string
+	WorkspaceName   string
+	WorkspacePrefix string
+	// WorkspaceTags is set when the workspace is selected by tags (only
+	// possible via the `cloud {}` block) rather than by a literal name or
+	// prefix. When set, the actual workspace name must still be resolved
+	// by cross-referencing .terraform/environment against the tagged
+	// workspaces returned by the TFE API.
+	WorkspaceTags string
+}
+
+// ErrWorkspaceNotFound is returned by UsingRemoteOps when the TFE workspace
+// implied by a project's backend config (by name, prefix, or tags) doesn't
+// exist, as opposed to a transport or authentication failure talking to
+// the TFE API. Callers can type-assert for this to distinguish the two.
+type ErrWorkspaceNotFound struct {
+	WorkspaceName string
+}
+
+func (e ErrWorkspaceNotFound) Error() string {
+	return fmt.Sprintf("no TFE workspace named %q found", e.WorkspaceName)
+}
+
+// resolveWorkspaceName determines which TFE workspace name corresponds to
+// atlantisWorkspace given how a project's backend config selects
+// workspaces: a literal WorkspaceName always wins, then tags (resolved via
+// resolveTagged), then WorkspacePrefix concatenated with atlantisWorkspace.
+func resolveWorkspaceName(backend RemoteBackend, atlantisWorkspace string, resolveTagged func(tags string) (string, error)) (string, error) {
+	switch {
+	case backend.WorkspaceName != "":
+		return backend.WorkspaceName, nil
+	case backend.WorkspaceTags != "":
+		return resolveTagged(backend.WorkspaceTags)
+	case backend.WorkspacePrefix != "":
+		return backend.WorkspacePrefix + atlantisWorkspace, nil
+	default:
+		return "", errors.New("backend config has no workspace name, prefix, or tags set")
+	}
+}
+
+// parseBackend reads and validates the statefile to determine whether this
+// project is configured for remote ops and, if so, extracts the backend
+// config needed to talk to the TFE API. It does no TFE API calls itself, so
+// callers (including the caching decorator) can use it cheaply to compute
+// a cache key before deciding whether an API round-trip is even needed.
+func (d *DefaultRemoteOpsChecker) parseBackend(log *logging.SimpleLogger, projectAbsPath string) (bool, RemoteBackend, error) {
 	log.Debug("reading statefile to check if using TFE remote ops")
 
 	// First, parse the statefile to determine the backend type.
@@ -29,9 +90,9 @@ func (d *DefaultRemoteOpsChecker) UsingRemoteOps(log *logging.SimpleLogger, work
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Warn("statefile does not exist, assuming not using remote ops")
-			return false, nil
+			return false, RemoteBackend{}, nil
 		}
-		return false, err
+		return false, RemoteBackend{}, err
 	}
 
 	type Statefile struct {
@@ -46,31 +107,57 @@ func (d *DefaultRemoteOpsChecker) UsingRemoteOps(log *logging.SimpleLogger, work
 				} `json:"workspaces,omitempty"`
 			} `json:"config,omitempty"`
 		} `json:"backend,omitempty"`
+		// Cloud is populated instead of Backend when the configuration uses
+		// Terraform 1.1+'s top-level `cloud {}` block rather than
+		// `backend "remote"`.
+		Cloud *struct {
+			Hostname     *string `json:"hostname,omitempty"`
+			Organization *string `json:"organization,omitempty"`
+			Workspaces   *struct {
+				Name string `json:"name,omitempty"`
+				Tags string `json:"tags,omitempty"`
+			} `json:"workspaces,omitempty"`
+		} `json:"cloud,omitempty"`
 	}
 
 	var statefile Statefile
 	err = json.Unmarshal(stateBytes, &statefile)
 	if err != nil {
-		return false, err
-	}
-
-	type RemoteBackend struct {
-		Hostname        string
-		Organization    string
-		WorkspaceName   string
-		WorkspacePrefix string
+		return false, RemoteBackend{}, err
 	}
 
 	// Validate the statefile.
 	isRemote, backend, err := (func(s Statefile) (bool, RemoteBackend, error) {
-		backend := statefile.Backend
+		if cloud := s.Cloud; cloud != nil {
+			if cloud.Organization == nil {
+				return false, RemoteBackend{}, errors.New("statefile has a cloud block but has no organization set")
+			}
+			org := *cloud.Organization
+
+			if cloud.Workspaces == nil || (cloud.Workspaces.Name == "" && cloud.Workspaces.Tags == "") {
+				return false, RemoteBackend{}, errors.New("statefile has a cloud block but workspaces has neither name nor tags set")
+			}
+
+			hostname := "app.terraform.io"
+			if cloud.Hostname != nil {
+				hostname = *cloud.Hostname
+			}
+			return true, RemoteBackend{
+				Hostname:      hostname,
+				Organization:  org,
+				WorkspaceName: cloud.Workspaces.Name,
+				WorkspaceTags: cloud.Workspaces.Tags,
+			}, nil
+		}
+
+		backend := s.Backend
 		if backend == nil {
-			log.Debug("statefile had no backend block so remote ops are not being used")
+			log.Debug("statefile had no backend or cloud block so remote ops are not being used")
 			return false, RemoteBackend{}, nil
 		}
 
 		if *backend.Type != "remote" {
-			log.Debug("statefile backend type is %q, not \"remote\" so remote ops are not being used", *statefile.Backend.Type)
+			log.Debug("statefile backend type is %q, not \"remote\" so remote ops are not being used", *backend.Type)
 			return false, RemoteBackend{}, nil
 		}
 
@@ -104,58 +191,47 @@ func (d *DefaultRemoteOpsChecker) UsingRemoteOps(log *logging.SimpleLogger, work
 	})(statefile)
 
 	if err != nil {
-		return false, err
+		return false, RemoteBackend{}, err
 	}
 	if !isRemote {
 		log.Debug("determined not using remote backend")
-		return false, nil
+		return false, RemoteBackend{}, nil
 	}
 
-	log.Debug("determined using remote backend with hostname: %q, org: %q, workspace name: %q, workspace prefix: %q",
-		backend.Hostname, backend.Organization, backend.WorkspaceName, backend.WorkspacePrefix)
+	log.Debug("determined using remote backend with hostname: %q, org: %q, workspace name: %q, workspace prefix: %q, workspace tags: %q",
+		backend.Hostname, backend.Organization, backend.WorkspaceName, backend.WorkspacePrefix, backend.WorkspaceTags)
+	return true, backend, nil
+}
 
-	// Read and parse the ~/.terraformrc file.
-	log.Debug("retrieving TFE token from .terraformrc file")
-	home, err := homedir.Dir()
-	if err != nil {
-		return false, errors.Wrap(err, "retrieving token from .terraformrc file")
-	}
-	rcFilePath := filepath.Join(home, ".terraformrc")
-	rcFileBytes, err := ioutil.ReadFile(rcFilePath)
-	if err != nil {
-		return false, errors.Wrap(err, "retrieving token from .terraformrc file")
-	}
-	obj, err := hcl.Parse(string(rcFileBytes))
+func (d *DefaultRemoteOpsChecker) UsingRemoteOps(log *logging.SimpleLogger, workspace string, projectAbsPath string) (bool, error) {
+	isRemote, backend, err := d.parseBackend(log, projectAbsPath)
 	if err != nil {
-		return false, errors.Wrap(err, "parsing .terraformrc file to retrieve TFE token")
-	}
-
-	type Config struct {
-		Credentials map[string]map[string]interface{} `hcl:"credentials"`
-	}
-	var rcFile Config
-	if err := hcl.DecodeObject(&rcFile, obj); err != nil {
-		return false, errors.Wrap(err, "decoding .terraformrc file to retrieve TFE token")
-	}
-
-	hostnameConf, ok := rcFile.Credentials[backend.Hostname]
-	if !ok {
-		return false, fmt.Errorf("found no credentials config for hostname %q in %q", backend.Hostname, rcFilePath)
+		return false, err
 	}
-	tokenGeneric, ok := hostnameConf["token"]
-	if !ok {
-		return false, fmt.Errorf("found no token key in config for hostname %q in %q", backend.Hostname, rcFilePath)
+	if !isRemote {
+		return false, nil
 	}
-	token := tokenGeneric.(string)
-	log.Debug("successfully found token for hostname %q", backend.Hostname)
+	return d.usingRemoteOpsForBackend(log, workspace, projectAbsPath, backend)
+}
 
-	// Now that we've got our token, we can make the TFE API call to figure out
-	// if this org uses the remote backend.
-	log.Debug("calling TFE API to determine entitlements")
-	client, err := tfe.NewClient(&tfe.Config{Token: token})
+// usingRemoteOpsForBackend does the actual TFE API calls (entitlements,
+// workspace lookup) for an already-parsed backend. It's split out from
+// UsingRemoteOps so that CachingRemoteOpsChecker, which must call
+// parseBackend itself to compute a cache key, can reuse this step on a
+// cache miss instead of parsing the statefile a second time.
+func (d *DefaultRemoteOpsChecker) usingRemoteOpsForBackend(log *logging.SimpleLogger, workspace string, projectAbsPath string, backend RemoteBackend) (bool, error) {
+	// Get (or create) the shared, authenticated client for this hostname
+	// rather than re-reading credentials and re-discovering the API on
+	// every check.
+	log.Debug("retrieving TFE client for hostname %q", backend.Hostname)
+	client, err := d.clients().ClientFor(backend.Hostname)
 	if err != nil {
 		return false, errors.Wrap(err, "creating TFE API client to determine if using remote ops")
 	}
+
+	// Now that we've got a client, we can make the TFE API call to figure
+	// out if this org uses the remote backend.
+	log.Debug("calling TFE API to determine entitlements")
 	entitlements, err := client.Organizations.Entitlements(context.Background(), backend.Organization)
 	if err != nil {
 		return false, errors.Wrap(err, "calling TFE API to determine if using remote ops")
@@ -170,18 +246,70 @@ func (d *DefaultRemoteOpsChecker) UsingRemoteOps(log *logging.SimpleLogger, work
 
 	// If they're entitled to use remote ops, we check if this workspace
 	// is using remote ops.
-	tfeWorkspaceName := backend.WorkspaceName
-	if backend.WorkspacePrefix != "" {
-		tfeWorkspaceName = backend.WorkspacePrefix + workspace
+	tfeWorkspaceName, err := resolveWorkspaceName(backend, workspace, func(tags string) (string, error) {
+		return resolveTaggedWorkspace(client, backend.Organization, tags, projectAbsPath)
+	})
+	if err != nil {
+		return false, err
 	}
 	log.Debug("organization %q has the operations entitlement. Now checking if workspace %q has remote ops enabled", backend.Organization, tfeWorkspaceName)
 	tfeWorkspace, err := client.Workspaces.Read(context.Background(), backend.Organization, tfeWorkspaceName)
 	if err != nil {
+		if errors.Is(err, tfe.ErrResourceNotFound) {
+			return false, ErrWorkspaceNotFound{WorkspaceName: tfeWorkspaceName}
+		}
 		return false, errors.Wrap(err, "calling TFE API to determine if using remote ops")
 	}
 	if tfeWorkspace == nil {
-		return false, errors.New("got nil workspace calling TFE API to determine if using remote ops")
+		return false, ErrWorkspaceNotFound{WorkspaceName: tfeWorkspaceName}
 	}
 	log.Debug("workspace %q has remote ops set to %t", tfeWorkspaceName, tfeWorkspace.Operations)
 	return tfeWorkspace.Operations, nil
 }
+
+// resolveTaggedWorkspace figures out which TFE workspace this project is
+// actually using when the `cloud {}` block selects workspaces by tags
+// rather than by a literal name. Terraform CLI records the currently
+// selected workspace in .terraform/environment, so we read that and then
+// confirm the workspace it names actually carries the configured tags,
+// rather than listing every tagged workspace in the org and scanning for
+// a name match -- which would silently miss the selected workspace if it
+// happened to land on page 2+ of a paginated List response.
+func resolveTaggedWorkspace(client *tfe.Client, organization string, tags string, projectAbsPath string) (string, error) {
+	envBytes, err := ioutil.ReadFile(filepath.Join(projectAbsPath, ".terraform/environment"))
+	if err != nil {
+		return "", errors.Wrap(err, "reading .terraform/environment to resolve tagged workspace")
+	}
+	selected := strings.TrimSpace(string(envBytes))
+	if selected == "" {
+		selected = "default"
+	}
+
+	ws, err := client.Workspaces.Read(context.Background(), organization, selected)
+	if err != nil {
+		if errors.Is(err, tfe.ErrResourceNotFound) {
+			return "", ErrWorkspaceNotFound{WorkspaceName: selected}
+		}
+		return "", errors.Wrap(err, "reading TFE workspace to resolve tagged workspace")
+	}
+
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if !containsTag(ws.TagNames, tag) {
+			return "", fmt.Errorf("workspace %q does not carry the configured tag %q", selected, tag)
+		}
+	}
+	return ws.Name, nil
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package runtime
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-tfe"
+	"github.com/runatlantis/atlantis/server/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveWorkspaceName(t *testing.T) {
+	unusedTagResolver := func(tags string) (string, error) {
+		t.Fatalf("tag resolver should not have been called, got tags %q", tags)
+		return "", nil
+	}
+
+	cases := []struct {
+		description       string
+		backend           RemoteBackend
+		atlantisWorkspace string
+		exp               string
+	}{
+		{
+			description:       "name only",
+			backend:           RemoteBackend{WorkspaceName: "my-workspace"},
+			atlantisWorkspace: "default",
+			exp:               "my-workspace",
+		},
+		{
+			description:       "prefix only",
+			backend:           RemoteBackend{WorkspacePrefix: "my-app-"},
+			atlantisWorkspace: "staging",
+			exp:               "my-app-staging",
+		},
+		{
+			description:       "prefix with the default atlantis workspace",
+			backend:           RemoteBackend{WorkspacePrefix: "my-app-"},
+			atlantisWorkspace: "default",
+			exp:               "my-app-default",
+		},
+		{
+			description:       "prefix with a non-default atlantis workspace produces a distinct workspace name",
+			backend:           RemoteBackend{WorkspacePrefix: "my-app-"},
+			atlantisWorkspace: "production",
+			exp:               "my-app-production",
+		},
+		{
+			description:       "name wins over prefix when both are somehow set",
+			backend:           RemoteBackend{WorkspaceName: "my-workspace", WorkspacePrefix: "my-app-"},
+			atlantisWorkspace: "production",
+			exp:               "my-workspace",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.description, func(t *testing.T) {
+			name, err := resolveWorkspaceName(c.backend, c.atlantisWorkspace, unusedTagResolver)
+			assert.NoError(t, err)
+			assert.Equal(t, c.exp, name)
+		})
+	}
+}
+
+func TestResolveWorkspaceName_Tags(t *testing.T) {
+	backend := RemoteBackend{WorkspaceTags: "app:prod"}
+	name, err := resolveWorkspaceName(backend, "default", func(tags string) (string, error) {
+		assert.Equal(t, "app:prod", tags)
+		return "tagged-workspace", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "tagged-workspace", name)
+}
+
+func TestResolveWorkspaceName_NoneSet(t *testing.T) {
+	_, err := resolveWorkspaceName(RemoteBackend{}, "default", func(tags string) (string, error) {
+		t.Fatal("tag resolver should not have been called")
+		return "", nil
+	})
+	assert.Error(t, err)
+}
+
+func TestErrWorkspaceNotFound_Error(t *testing.T) {
+	err := ErrWorkspaceNotFound{WorkspaceName: "my-workspace"}
+	assert.Contains(t, err.Error(), "my-workspace")
+}
+
+// TestUsingRemoteOps_MismatchedWorkspaceSurfacesErrWorkspaceNotFound exercises
+// UsingRemoteOps end-to-end against a stubbed TFE API: the project's
+// statefile names a workspace the org is entitled for remote ops on, but
+// that workspace doesn't exist in TFE (e.g. because it was renamed or
+// belongs to a different Atlantis workspace), so the API returns a 404 for
+// it. UsingRemoteOps must surface that as ErrWorkspaceNotFound specifically,
+// not some other wrapped error, so callers can tell "not configured for
+// remote ops" apart from "misconfigured/nonexistent workspace."
+func TestUsingRemoteOps_MismatchedWorkspaceSurfacesErrWorkspaceNotFound(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/organizations/acme/entitlement-set", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		w.Write([]byte(`{"data":{"id":"acme","type":"entitlement-sets","attributes":{"operations":true}}}`)) // nolint: errcheck
+	})
+	mux.HandleFunc("/api/v2/organizations/acme/workspaces/expected-workspace", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[{"status":"404","title":"not found"}]}`)) // nolint: errcheck
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client, err := tfe.NewClient(&tfe.Config{Address: ts.URL, Token: "test-token"})
+	assert.NoError(t, err)
+
+	projectAbsPath := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(projectAbsPath, ".terraform"), 0700))
+	statefile := `{
+		"backend": {
+			"type": "remote",
+			"config": {
+				"hostname": "test-host",
+				"organization": "acme",
+				"workspaces": [{"name": "expected-workspace"}]
+			}
+		}
+	}`
+	assert.NoError(t, os.WriteFile(filepath.Join(projectAbsPath, ".terraform/terraform.tfstate"), []byte(statefile), 0600))
+
+	checker := &DefaultRemoteOpsChecker{
+		Clients: &TFEClientFactory{clients: map[string]*tfe.Client{"test-host": client}},
+	}
+	_, err = checker.UsingRemoteOps(&logging.SimpleLogger{}, "default", projectAbsPath)
+	assert.Error(t, err)
+	notFound, ok := err.(ErrWorkspaceNotFound)
+	assert.True(t, ok, "expected ErrWorkspaceNotFound, got %T: %s", err, err)
+	assert.Equal(t, "expected-workspace", notFound.WorkspaceName)
+}
@@ -0,0 +1,274 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-tfe"
+	"github.com/pkg/errors"
+	"github.com/runatlantis/atlantis/server/logging"
+)
+
+// pollInterval is how often we poll the TFE API for run status updates.
+// TFE's own CLI driver uses a similar backoff but a fixed interval is
+// simpler to reason about and is well within TFE's rate limits.
+var pollInterval = 2 * time.Second
+
+// terminalRunStatuses are the tfe.RunStatus values that mean the run is no
+// longer progressing and we should stop polling.
+var terminalRunStatuses = map[tfe.RunStatus]bool{
+	tfe.RunApplied:            true,
+	tfe.RunCanceled:           true,
+	tfe.RunDiscarded:          true,
+	tfe.RunErrored:            true,
+	tfe.RunPlannedAndFinished: true,
+	tfe.RunPolicySoftFailed:   true,
+}
+
+// RemoteRunConfig describes the TFE workspace a RemoteRunner should drive a
+// run against.
+type RemoteRunConfig struct {
+	Hostname      string
+	Organization  string
+	WorkspaceName string
+	// ProjectAbsPath is the directory containing the Terraform configuration
+	// to upload as the configuration version.
+	ProjectAbsPath string
+}
+
+// RemoteRunResult is returned once a run reaches a terminal state. Output is
+// the combined plan/apply log suitable for inclusion in a PR comment.
+type RemoteRunResult struct {
+	Output             string
+	CostEstimateOutput string
+	PolicyCheckOutput  string
+	RunURL             string
+	Success            bool
+}
+
+// RemoteRunner drives a full remote operation (plan or apply) against a TFE
+// workspace, the way Terraform's own "remote" backend does when invoked
+// from the CLI. Unlike RemoteOpsChecker, which only detects that a
+// workspace is configured for remote ops, RemoteRunner actually executes
+// the operation and streams its output back.
+type RemoteRunner struct {
+	// Clients is shared with DefaultRemoteOpsChecker so that credential
+	// lookup and service discovery happen once per hostname rather than
+	// once per workflow.
+	Clients *TFEClientFactory
+}
+
+// NewRemoteRunner constructs a RemoteRunner using the default credentials
+// provider chain.
+func NewRemoteRunner() *RemoteRunner {
+	return &RemoteRunner{Clients: NewTFEClientFactory()}
+}
+
+func (r *RemoteRunner) clients() *TFEClientFactory {
+	if r.Clients == nil {
+		r.Clients = NewTFEClientFactory()
+	}
+	return r.Clients
+}
+
+// Plan uploads the configuration at cfg.ProjectAbsPath and creates a
+// speculative run, i.e. one whose result can be inspected but never
+// applied. This matches what `terraform plan` does against the remote
+// backend.
+func (r *RemoteRunner) Plan(log *logging.SimpleLogger, cfg RemoteRunConfig) (RemoteRunResult, error) {
+	return r.run(log, cfg, true)
+}
+
+// Apply uploads the configuration at cfg.ProjectAbsPath and creates a
+// non-speculative run, confirming it for apply once planning succeeds.
+// This matches what `terraform apply` does against the remote backend.
+func (r *RemoteRunner) Apply(log *logging.SimpleLogger, cfg RemoteRunConfig) (RemoteRunResult, error) {
+	return r.run(log, cfg, false)
+}
+
+// Cancel cancels an in-progress run, for example when the PR backing it is
+// closed before the run finishes.
+func (r *RemoteRunner) Cancel(log *logging.SimpleLogger, cfg RemoteRunConfig, runID string) error {
+	client, err := r.clients().ClientFor(cfg.Hostname)
+	if err != nil {
+		return errors.Wrap(err, "creating TFE API client to cancel run")
+	}
+	log.Info("cancelling TFE run %q", runID)
+	if err := client.Runs.Cancel(context.Background(), runID, tfe.RunCancelOptions{}); err != nil {
+		return errors.Wrap(err, "cancelling TFE run")
+	}
+	return nil
+}
+
+func (r *RemoteRunner) run(log *logging.SimpleLogger, cfg RemoteRunConfig, speculative bool) (RemoteRunResult, error) {
+	client, err := r.clients().ClientFor(cfg.Hostname)
+	if err != nil {
+		return RemoteRunResult{}, errors.Wrap(err, "creating TFE API client to drive remote run")
+	}
+
+	log.Debug("looking up TFE workspace %q to drive remote run", cfg.WorkspaceName)
+	workspace, err := client.Workspaces.Read(context.Background(), cfg.Organization, cfg.WorkspaceName)
+	if err != nil {
+		return RemoteRunResult{}, errors.Wrap(err, "reading TFE workspace to drive remote run")
+	}
+
+	cv, err := client.ConfigurationVersions.Create(context.Background(), workspace.ID, tfe.ConfigurationVersionCreateOptions{
+		AutoQueueRuns: tfe.Bool(false),
+		Speculative:   tfe.Bool(speculative),
+	})
+	if err != nil {
+		return RemoteRunResult{}, errors.Wrap(err, "creating configuration version")
+	}
+
+	log.Debug("uploading configuration from %q as configuration version %q", cfg.ProjectAbsPath, cv.ID)
+	if err := client.ConfigurationVersions.Upload(context.Background(), cv.UploadURL, cfg.ProjectAbsPath); err != nil {
+		return RemoteRunResult{}, errors.Wrap(err, "uploading configuration version")
+	}
+
+	if err := r.waitForConfigurationVersion(client, cv.ID); err != nil {
+		return RemoteRunResult{}, err
+	}
+
+	run, err := client.Runs.Create(context.Background(), tfe.RunCreateOptions{
+		IsDestroy:            tfe.Bool(false),
+		ConfigurationVersion: cv,
+		Workspace:            workspace,
+	})
+	if err != nil {
+		return RemoteRunResult{}, errors.Wrap(err, "creating run")
+	}
+	runURL := fmt.Sprintf("https://%s/app/%s/workspaces/%s/runs/%s", cfg.Hostname, cfg.Organization, cfg.WorkspaceName, run.ID)
+	log.Info("created TFE run %q: %s", run.ID, runURL)
+
+	run, err = r.pollUntilTerminal(log, client.Runs, run.ID)
+	if err != nil {
+		return RemoteRunResult{}, err
+	}
+
+	var out strings.Builder
+	if planOutput, err := r.streamLogs(client.Plans.Logs, run.Plan.ID); err != nil {
+		log.Warn("reading plan logs: %s", err)
+	} else {
+		out.WriteString(planOutput)
+	}
+
+	var costEstimateOutput string
+	if run.CostEstimate != nil {
+		ce, err := client.CostEstimates.Read(context.Background(), run.CostEstimate.ID)
+		if err != nil {
+			log.Warn("reading cost estimate: %s", err)
+		} else {
+			costEstimateOutput = fmt.Sprintf("Resources: %d of %d estimated\nDelta: %s/mo", ce.MatchedResourcesCount, ce.ResourcesCount, ce.DeltaMonthlyCost)
+		}
+	}
+
+	policyCheckOutput, err := r.policyCheckOutput(client, run.ID)
+	if err != nil {
+		log.Warn("reading policy check results: %s", err)
+	}
+
+	if !speculative && run.Apply != nil {
+		applyOutput, err := r.streamLogs(client.Applies.Logs, run.Apply.ID)
+		if err != nil {
+			log.Warn("reading apply logs: %s", err)
+		} else {
+			out.WriteString("\n")
+			out.WriteString(applyOutput)
+		}
+	}
+
+	success := run.Status == tfe.RunPlannedAndFinished || run.Status == tfe.RunApplied
+	return RemoteRunResult{
+		Output:             out.String(),
+		CostEstimateOutput: costEstimateOutput,
+		PolicyCheckOutput:  policyCheckOutput,
+		RunURL:             runURL,
+		Success:            success,
+	}, nil
+}
+
+// waitForConfigurationVersion polls until the uploaded configuration
+// version has finished processing and is ready to be used in a run.
+func (r *RemoteRunner) waitForConfigurationVersion(client *tfe.Client, cvID string) error {
+	for {
+		cv, err := client.ConfigurationVersions.Read(context.Background(), cvID)
+		if err != nil {
+			return errors.Wrap(err, "reading configuration version status")
+		}
+		switch cv.Status {
+		case tfe.ConfigurationUploaded:
+			return nil
+		case tfe.ConfigurationErrored:
+			return errors.New("configuration version failed to process")
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// pollUntilTerminal polls the run until it reaches a terminal status,
+// confirming the apply once planning (and any policy checks) finish
+// successfully for non-speculative runs (speculative runs finish on their
+// own at "planned_and_finished"). A run that lands on RunPolicyOverride
+// means a soft-mandatory Sentinel/OPA check failed and is waiting on an
+// explicit override decision; we deliberately do not confirm that run
+// ourselves, since doing so would silently bypass the policy check. It's
+// left pending until an operator overrides it (or discards the run)
+// through TFE directly. A run that lands on RunPolicySoftFailed is never
+// confirmed either.
+//
+// runs is narrowed to tfe.Runs (rather than taking the whole *tfe.Client)
+// so this loop's status-transition logic can be exercised against a fake
+// in tests.
+func (r *RemoteRunner) pollUntilTerminal(log *logging.SimpleLogger, runs tfe.Runs, runID string) (*tfe.Run, error) {
+	confirmed := false
+	for {
+		run, err := runs.Read(context.Background(), runID)
+		if err != nil {
+			return nil, errors.Wrap(err, "polling run status")
+		}
+		log.Debug("run %q status: %s", runID, run.Status)
+
+		if !confirmed && run.Actions != nil && run.Actions.IsConfirmable && run.Status != tfe.RunPolicyOverride && run.Status != tfe.RunPolicySoftFailed {
+			if err := runs.Apply(context.Background(), runID, tfe.RunApplyOptions{}); err != nil {
+				return nil, errors.Wrap(err, "confirming run for apply")
+			}
+			// Only ever confirm once: if TFE hasn't flipped IsConfirmable
+			// to false by the next poll, calling Apply again would just
+			// error out even though the run itself is proceeding fine.
+			confirmed = true
+		}
+
+		if terminalRunStatuses[run.Status] {
+			return run, nil
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func (r *RemoteRunner) policyCheckOutput(client *tfe.Client, runID string) (string, error) {
+	checks, err := client.PolicyChecks.List(context.Background(), runID, &tfe.PolicyCheckListOptions{})
+	if err != nil {
+		return "", errors.Wrap(err, "listing policy checks")
+	}
+	var out strings.Builder
+	for _, pc := range checks.Items {
+		out.WriteString(fmt.Sprintf("Policy check %q: %s\n", pc.ID, pc.Status))
+	}
+	return out.String(), nil
+}
+
+func (r *RemoteRunner) streamLogs(logsFn func(ctx context.Context, id string) (io.Reader, error), id string) (string, error) {
+	reader, err := logsFn(context.Background(), id)
+	if err != nil {
+		return "", err
+	}
+	bytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
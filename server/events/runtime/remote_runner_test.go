@@ -0,0 +1,102 @@
+package runtime
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-tfe"
+	"github.com/runatlantis/atlantis/server/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRunsService implements just enough of tfe.Runs for pollUntilTerminal.
+// Embedding the interface gives us a zero-value implementation of the
+// methods we don't care about (which would panic if ever called, since
+// they're nil), so tests only need to override Read and Apply.
+type fakeRunsService struct {
+	tfe.Runs
+
+	statuses []tfe.RunStatus
+	readIdx  int
+
+	applyCalls int
+	applyErr   error
+}
+
+func (f *fakeRunsService) Read(ctx context.Context, runID string) (*tfe.Run, error) {
+	status := f.statuses[f.readIdx]
+	if f.readIdx < len(f.statuses)-1 {
+		f.readIdx++
+	}
+	run := &tfe.Run{
+		ID:     runID,
+		Status: status,
+	}
+	if status != tfe.RunPlanned && status != tfe.RunPolicyOverride {
+		run.Actions = &tfe.RunActions{IsConfirmable: true}
+	}
+	return run, nil
+}
+
+func (f *fakeRunsService) Apply(ctx context.Context, runID string, options tfe.RunApplyOptions) error {
+	f.applyCalls++
+	return f.applyErr
+}
+
+func newTestLogger() *logging.SimpleLogger {
+	return &logging.SimpleLogger{}
+}
+
+func TestPollUntilTerminal_ConfirmsExactlyOnce(t *testing.T) {
+	origInterval := pollInterval
+	pollInterval = time.Millisecond
+	defer func() { pollInterval = origInterval }()
+
+	runs := &fakeRunsService{
+		statuses: []tfe.RunStatus{
+			tfe.RunPlanned,
+			tfe.RunPolicyChecked,
+			tfe.RunPolicyChecked,
+			tfe.RunPlannedAndFinished,
+		},
+	}
+	r := &RemoteRunner{}
+	run, err := r.pollUntilTerminal(newTestLogger(), runs, "run-123")
+	assert.NoError(t, err)
+	assert.Equal(t, tfe.RunPlannedAndFinished, run.Status)
+	assert.Equal(t, 1, runs.applyCalls, "Apply should only be called once even though IsConfirmable stayed true across polls")
+}
+
+func TestPollUntilTerminal_DoesNotConfirmPolicyOverride(t *testing.T) {
+	origInterval := pollInterval
+	pollInterval = time.Millisecond
+	defer func() { pollInterval = origInterval }()
+
+	runs := &fakeRunsService{
+		statuses: []tfe.RunStatus{
+			tfe.RunPolicyOverride,
+			tfe.RunPolicyOverride,
+			tfe.RunPolicySoftFailed,
+		},
+	}
+	r := &RemoteRunner{}
+	run, err := r.pollUntilTerminal(newTestLogger(), runs, "run-123")
+	assert.NoError(t, err)
+	assert.Equal(t, tfe.RunPolicySoftFailed, run.Status)
+	assert.Equal(t, 0, runs.applyCalls, "a run awaiting a policy override should never be auto-confirmed")
+}
+
+func TestPollUntilTerminal_ReturnsApplyError(t *testing.T) {
+	origInterval := pollInterval
+	pollInterval = time.Millisecond
+	defer func() { pollInterval = origInterval }()
+
+	runs := &fakeRunsService{
+		statuses: []tfe.RunStatus{tfe.RunPlannedAndFinished},
+		applyErr: assert.AnError,
+	}
+	r := &RemoteRunner{}
+	_, err := r.pollUntilTerminal(newTestLogger(), runs, "run-123")
+	assert.Error(t, err)
+}